@@ -0,0 +1,33 @@
+package caching
+
+// Caching is the interface implemented by the various caching backends
+// (BoltDB, in-memory, ...) used to resolve app/space/org metadata for
+// incoming firehose events.
+type Caching interface {
+	Open() error
+	Close() error
+	FillCache() error
+	GetApp(string) (*App, error)
+}
+
+// App is the resolved, flattened view of a CF application plus its space
+// and organization, as returned by Caching.GetApp.
+type App struct {
+	Guid       string
+	Name       string
+	SpaceGuid  string
+	SpaceName  string
+	OrgGuid    string
+	OrgName    string
+	IgnoredApp bool
+
+	// Environment holds the app's environment variables, as returned by the
+	// Cloud Controller API.
+	Environment map[string]interface{}
+
+	// Labels and Annotations are only populated when the backend is
+	// configured to talk to the Cloud Controller v3 API, which exposes
+	// Kubernetes-style metadata on resources.
+	Labels      map[string]string
+	Annotations map[string]string
+}
@@ -3,16 +3,13 @@ package caching
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
-	"net/http"
 	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	uuid "github.com/satori/go.uuid"
 )
@@ -21,18 +18,6 @@ var (
 	APP_BUCKET = []byte("AppBucketV2")
 )
 
-type entity struct {
-	Name             string                 `json:"name"`
-	SpaceGUID        string                 `json:"space_guid"`
-	OrganizationGUID string                 `json:"organization_guid"`
-	Environment      map[string]interface{} `json:"environment_json"`
-	TTL              time.Time
-}
-
-func (e *entity) appIsOptOut() bool {
-	return e.Environment["F2S_DISABLE_LOGGING"] == "true"
-}
-
 type CachingBoltConfig struct {
 	// Path the a boltdb file to persist data to
 	Path string
@@ -43,27 +28,93 @@ type CachingBoltConfig struct {
 	// CacheInvalidateTTL is the approx TTL for cached data. Code will randomly pick between 0.75x and 1.2
 	CacheInvalidateTTL time.Duration
 	StripAppSuffixes   []string
+
+	// APIVersion selects which Cloud Controller API is used to resolve apps,
+	// spaces and organizations: "v2" (default) or "v3". v3 is required to
+	// read Kubernetes-style labels/annotations on resources.
+	APIVersion string
+
+	// IncludeSelector and ExcludeSelector are Kubernetes-style selector
+	// expressions (e.g. "team=platform,tier!=batch") evaluated against an
+	// app's environment variables and, when using the v3 API, its labels
+	// and annotations. Apps that fail IncludeSelector or match
+	// ExcludeSelector are returned with IgnoredApp set. Empty strings match
+	// everything/nothing respectively.
+	IncludeSelector string
+	ExcludeSelector string
 }
 
 type CachingBolt struct {
 	client *cfclient.Client
+	cc     *ccClient
 	appdb  *bolt.DB
 
-	config *CachingBoltConfig
+	config          *CachingBoltConfig
+	logger          logger
+	includeSelector *selector
+	excludeSelector *selector
+	metrics         *metrics
 }
 
-func NewCachingBolt(client *cfclient.Client, config *CachingBoltConfig) (*CachingBolt, error) {
+// NewCachingBolt constructs a BoltDB-backed Caching. Use the With* functions
+// to configure it, e.g. WithPath, WithTTL, WithIgnoreMissingApps.
+func NewCachingBolt(client *cfclient.Client, opts ...Option) (*CachingBolt, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	includeSelector, err := parseSelector(o.includeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("include selector: %s", err)
+	}
+	excludeSelector, err := parseSelector(o.excludeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("exclude selector: %s", err)
+	}
+
+	m := newMetrics(o.metricsRegisterer)
+
 	return &CachingBolt{
-		client: client,
-		config: config,
+		client:          client,
+		cc:              &ccClient{client: client, apiVersion: o.apiVersion, metrics: m},
+		logger:          o.logger,
+		includeSelector: includeSelector,
+		excludeSelector: excludeSelector,
+		metrics:         m,
+		config: &CachingBoltConfig{
+			Path:               o.path,
+			IgnoreMissingApps:  o.ignoreMissingApps,
+			CacheInvalidateTTL: o.cacheInvalidateTTL,
+			StripAppSuffixes:   o.stripAppSuffixes,
+			APIVersion:         o.apiVersion,
+			IncludeSelector:    o.includeSelector,
+			ExcludeSelector:    o.excludeSelector,
+		},
 	}, nil
 }
 
+// NewCachingBoltWithConfig constructs a BoltDB-backed Caching from a
+// CachingBoltConfig.
+//
+// Deprecated: prefer NewCachingBolt with the With* options instead.
+func NewCachingBoltWithConfig(client *cfclient.Client, config *CachingBoltConfig) (*CachingBolt, error) {
+	return NewCachingBolt(client,
+		WithPath(config.Path),
+		WithTTL(config.CacheInvalidateTTL),
+		WithIgnoreMissingApps(config.IgnoreMissingApps),
+		WithStripAppSuffixes(config.StripAppSuffixes),
+		WithAPIVersion(config.APIVersion),
+		WithIncludeSelector(config.IncludeSelector),
+		WithExcludeSelector(config.ExcludeSelector),
+	)
+}
+
 func (c *CachingBolt) Open() error {
 	// Open bolt db
 	db, err := bolt.Open(c.config.Path, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		logging.LogError("Fail to open boltdb: ", err)
+		c.logger.LogError("Fail to open boltdb: ", err)
 		return err
 	}
 	c.appdb = db
@@ -76,7 +127,7 @@ func (c *CachingBolt) Open() error {
 		return nil
 	})
 	if err != nil {
-		logging.LogError("Fail to create bucket: ", err)
+		c.logger.LogError("Fail to create bucket: ", err)
 		return err
 	}
 
@@ -86,7 +137,10 @@ func (c *CachingBolt) Open() error {
 // FillAppCache communicates with the server to enumerate *all* applications and fills
 // the cache
 func (c *CachingBolt) FillCache() error {
-	allApps, err := c.fetchEntityListFromAPI("apps")
+	start := time.Now()
+	defer func() { c.metrics.fillCacheDuration.Observe(time.Since(start).Seconds()) }()
+
+	allApps, err := c.cc.fetchEntityListFromAPI("apps")
 	if err != nil {
 		return err
 	}
@@ -113,6 +167,8 @@ func (c *CachingBolt) FillCache() error {
 		}
 	}
 
+	c.metrics.fillCacheAppsTotal.Add(float64(len(allApps)))
+
 	return nil
 }
 
@@ -149,6 +205,7 @@ func (c *CachingBolt) getEntity(entityType, guid string) (*entity, error) {
 	switch err {
 	case nil:
 		if rv.TTL.Before(time.Now()) {
+			c.metrics.cacheHits.WithLabelValues(entityType).Inc()
 			return &rv, nil
 		}
 		// else continue
@@ -158,8 +215,10 @@ func (c *CachingBolt) getEntity(entityType, guid string) (*entity, error) {
 		return nil, err
 	}
 
+	c.metrics.cacheMisses.WithLabelValues(entityType).Inc()
+
 	// Fetch from remote
-	nv, err := c.fetchEntityFromAPI(entityType, uuid)
+	nv, err := c.cc.fetchEntityFromAPI(entityType, uuid)
 	if err != nil {
 		if entityType == "apps" && c.config.IgnoreMissingApps {
 			nv = &entity{}
@@ -216,71 +275,30 @@ func (c *CachingBolt) normaliseAndSaveEntityToDatabase(entityType, uuid string,
 		return err
 	}
 
-	return nil
-}
-
-// fetchEntityListFromAPI fetches a full list of all such entities from the server
-// entityType must have been validated by the caller
-func (c *CachingBolt) fetchEntityListFromAPI(entityType string) (map[string]*entity, error) {
-	url := fmt.Sprintf("/v2/%s?results-per-page=100", entityType)
-	rv := make(map[string]*entity)
-	for {
-		var md struct {
-			NextURL   string `json:"next_url"`
-			Resources []*struct {
-				Metadata struct {
-					GUID string `json:"guid"`
-				} `json:"metadata"`
-				Entity *entity `json:"entity"`
-			} `json:"resources"`
-		}
-		err := c.makeRequestAndDecodeJSON(url, &md)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, r := range md.Resources {
-			rv[r.Metadata.GUID] = r.Entity
-		}
-
-		if md.NextURL == "" {
-			// we're done!
-			return rv, nil
-		}
-
-		url = md.NextURL
-	}
-}
-
-func (c *CachingBolt) makeRequestAndDecodeJSON(url string, rv interface{}) error {
-	resp, err := c.client.DoRequestWithoutRedirects(c.client.NewRequest(http.MethodGet, url))
+	count, err := c.countEntities(entityType)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	c.metrics.cachedEntities.WithLabelValues(entityType).Set(float64(count))
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %s", resp.Status)
-	}
-
-	err = json.NewDecoder(resp.Body).Decode(rv)
-	if err != nil {
-		return err
-	}
-
-	return err
+	return nil
 }
 
-// both entityType and guid must have been validated by the caller
-func (c *CachingBolt) fetchEntityFromAPI(entityType, guid string) (*entity, error) {
-	var md struct {
-		Entity *entity `json:"entity"`
-	}
-	err := c.makeRequestAndDecodeJSON(fmt.Sprintf("/v2/%s/%s", entityType, guid), &md)
-	if err != nil {
-		return nil, err
-	}
-	return md.Entity, nil
+// countEntities returns the number of keys currently stored for entityType,
+// for cachedEntities' occupancy gauge. A bucket scan rather than a running
+// counter, since TTL expiry and process restarts would otherwise drift it
+// from the bucket's actual contents.
+func (c *CachingBolt) countEntities(entityType string) (int, error) {
+	prefix := []byte(entityType + "/")
+	var count int
+	err := c.appdb.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(APP_BUCKET).Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
 }
 
 func (c *CachingBolt) getSpaceAndOrg(spaceGuid string) (*entity, *entity, error) {
@@ -321,12 +339,15 @@ func (c *CachingBolt) GetApp(appGuid string) (*App, error) {
 	}
 
 	return &App{
-		Guid:       appGuid,
-		Name:       app.Name,
-		SpaceGuid:  app.SpaceGUID,
-		SpaceName:  space.Name,
-		OrgGuid:    space.OrganizationGUID,
-		OrgName:    org.Name,
-		IgnoredApp: app.appIsOptOut(),
+		Guid:        appGuid,
+		Name:        app.Name,
+		SpaceGuid:   app.SpaceGUID,
+		SpaceName:   space.Name,
+		OrgGuid:     space.OrganizationGUID,
+		OrgName:     org.Name,
+		IgnoredApp:  isIgnoredApp(app, c.includeSelector, c.excludeSelector),
+		Environment: app.Environment,
+		Labels:      app.Labels,
+		Annotations: app.Annotations,
 	}, nil
 }
@@ -1,9 +1,8 @@
 package caching
 
 import (
-	"encoding/json"
 	"fmt"
-	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,21 +10,16 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
-type entity struct {
-	Name             string                 `json:"name"`
-	SpaceGUID        string                 `json:"space_guid"`
-	OrganizationGUID string                 `json:"organization_guid"`
-	Environment      map[string]interface{} `json:"environment_json"`
-	TTL              time.Time
-}
-
-func (e *entity) appIsOptOut() bool {
-	return e.Environment["F2S_DISABLE_LOGGING"] == "true"
-}
-
 type CachingMemoryConfig struct {
 	IgnoreMissingApps  bool
 	CacheInvalidateTTL time.Duration
+
+	// APIVersion, see CachingBoltConfig.APIVersion.
+	APIVersion string
+
+	// IncludeSelector and ExcludeSelector, see CachingBoltConfig.IncludeSelector.
+	IncludeSelector string
+	ExcludeSelector string
 }
 
 type CachingMemory struct {
@@ -33,18 +27,64 @@ type CachingMemory struct {
 	entityCache     map[string]*entity
 
 	client *cfclient.Client
+	cc     *ccClient
 
-	config *CachingMemoryConfig
+	config          *CachingMemoryConfig
+	includeSelector *selector
+	excludeSelector *selector
+	metrics         *metrics
 }
 
-func NewCachingMemory(client *cfclient.Client, config *CachingMemoryConfig) (*CachingMemory, error) {
+// NewCachingMemory constructs an in-memory Caching. Use the With* functions
+// to configure it, e.g. WithTTL, WithIgnoreMissingApps.
+func NewCachingMemory(client *cfclient.Client, opts ...Option) (*CachingMemory, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	includeSelector, err := parseSelector(o.includeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("include selector: %s", err)
+	}
+	excludeSelector, err := parseSelector(o.excludeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("exclude selector: %s", err)
+	}
+
+	m := newMetrics(o.metricsRegisterer)
+
 	return &CachingMemory{
-		entityCache: make(map[string]*entity),
-		config:      config,
-		client:      client,
+		entityCache:     make(map[string]*entity),
+		client:          client,
+		cc:              &ccClient{client: client, apiVersion: o.apiVersion, metrics: m},
+		includeSelector: includeSelector,
+		excludeSelector: excludeSelector,
+		metrics:         m,
+		config: &CachingMemoryConfig{
+			IgnoreMissingApps:  o.ignoreMissingApps,
+			CacheInvalidateTTL: o.cacheInvalidateTTL,
+			APIVersion:         o.apiVersion,
+			IncludeSelector:    o.includeSelector,
+			ExcludeSelector:    o.excludeSelector,
+		},
 	}, nil
 }
 
+// NewCachingMemoryWithConfig constructs an in-memory Caching from a
+// CachingMemoryConfig.
+//
+// Deprecated: prefer NewCachingMemory with the With* options instead.
+func NewCachingMemoryWithConfig(client *cfclient.Client, config *CachingMemoryConfig) (*CachingMemory, error) {
+	return NewCachingMemory(client,
+		WithTTL(config.CacheInvalidateTTL),
+		WithIgnoreMissingApps(config.IgnoreMissingApps),
+		WithAPIVersion(config.APIVersion),
+		WithIncludeSelector(config.IncludeSelector),
+		WithExcludeSelector(config.ExcludeSelector),
+	)
+}
+
 func (cm *CachingMemory) Open() error {
 	return nil
 }
@@ -70,37 +110,46 @@ func (cm *CachingMemory) getEntity(entityType, guid string) (*entity, error) {
 
 	// For now, let's do a brainread mutex here. Later we can optimize...
 	cm.entityCacheLock.Lock()
-	defer cm.entityCacheLock.Unlock()
-
-	// Return value if we have one
 	rv, found := cm.entityCache[key]
+	cm.entityCacheLock.Unlock()
 	if found && rv.TTL.Before(time.Now()) {
+		cm.metrics.cacheHits.WithLabelValues(entityType).Inc()
 		return rv, nil
 	}
+	cm.metrics.cacheMisses.WithLabelValues(entityType).Inc()
 
-	// Let's fetch it
-	resp, err := cm.client.DoRequestWithoutRedirects(cm.client.NewRequest(http.MethodGet, fmt.Sprintf("/v2/%s/%s", entityType, uuid)))
+	// Let's fetch it. This is done outside the lock, and coalesced across
+	// concurrent callers by cc.fetchEntityFromAPI, so a cold-cache burst of
+	// firehose events for the same app doesn't serialize behind one mutex
+	// or stampede the Cloud Controller API.
+	nv, err := cm.cc.fetchEntityFromAPI(entityType, uuid)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %s", resp.Status)
-	}
-
-	var md struct {
-		Entity entity `json:"entity"`
-	}
-	err = json.NewDecoder(resp.Body).Decode(&md)
-	if err != nil {
-		return nil, err
-	}
+	nv.TTL = time.Now().Add(cm.config.CacheInvalidateTTL)
+	cm.entityCacheLock.Lock()
+	cm.entityCache[key] = nv
+	count := cm.countEntitiesLocked(entityType)
+	cm.entityCacheLock.Unlock()
+	cm.metrics.cachedEntities.WithLabelValues(entityType).Set(float64(count))
 
-	md.Entity.TTL = time.Now().Add(cm.config.CacheInvalidateTTL)
-	cm.entityCache[key] = &md.Entity
+	return nv, nil
+}
 
-	return &md.Entity, nil
+// countEntitiesLocked returns the number of cached entries for entityType,
+// for cachedEntities' occupancy gauge. A map scan rather than a running
+// counter, since TTL expiry would otherwise drift it from entityCache's
+// actual contents. Callers must hold entityCacheLock.
+func (cm *CachingMemory) countEntitiesLocked(entityType string) int {
+	prefix := entityType + "/"
+	var count int
+	for k := range cm.entityCache {
+		if strings.HasPrefix(k, prefix) {
+			count++
+		}
+	}
+	return count
 }
 
 func (cm *CachingMemory) GetApp(appGuid string) (*App, error) {
@@ -132,12 +181,15 @@ func (cm *CachingMemory) GetApp(appGuid string) (*App, error) {
 	}
 
 	return &App{
-		Guid:       appGuid,
-		Name:       app.Name,
-		SpaceGuid:  app.SpaceGUID,
-		SpaceName:  space.Name,
-		OrgGuid:    space.OrganizationGUID,
-		OrgName:    org.Name,
-		IgnoredApp: app.appIsOptOut(),
+		Guid:        appGuid,
+		Name:        app.Name,
+		SpaceGuid:   app.SpaceGUID,
+		SpaceName:   space.Name,
+		OrgGuid:     space.OrganizationGUID,
+		OrgName:     org.Name,
+		IgnoredApp:  isIgnoredApp(app, cm.includeSelector, cm.excludeSelector),
+		Environment: app.Environment,
+		Labels:      app.Labels,
+		Annotations: app.Annotations,
 	}, nil
 }
@@ -0,0 +1,375 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/go-redis/redis"
+	uuid "github.com/satori/go.uuid"
+)
+
+// fillCacheLockKey guards FillCache so that multiple firehose-to-syslog
+// instances sharing a Redis cache don't all hammer the Cloud Controller API
+// for the same full app list at once.
+const fillCacheLockKey = "firehose-to-syslog/fillcache-lock"
+
+// fillCacheLockTTL and fillCacheLockRenewInterval bound how long a crashed
+// or stuck FillCache can hold the lock. The lock is independent of
+// CacheInvalidateTTL - reusing that duration would make the lock last as
+// long as a cache entry, which a cold-cache full sweep of a large
+// foundation can easily outrun, letting a second instance start a
+// concurrent sweep. Instead the lock is held for a short TTL and renewed
+// periodically for as long as FillCache is actually running.
+const (
+	fillCacheLockTTL           = 30 * time.Second
+	fillCacheLockRenewInterval = fillCacheLockTTL / 3
+)
+
+type CachingRedisConfig struct {
+	// Addr is the "host:port" of the Redis server.
+	Addr string
+
+	// Password authenticates to Redis, if set.
+	Password string
+
+	// DB selects the numbered Redis database to use.
+	DB int
+
+	// IgnoreMissingApps no error if an app can't be found
+	IgnoreMissingApps bool
+
+	// CacheInvalidateTTL is the approx TTL for cached data. Code will randomly pick between 0.75x and 1.25x
+	CacheInvalidateTTL time.Duration
+	StripAppSuffixes   []string
+
+	// APIVersion, see CachingBoltConfig.APIVersion.
+	APIVersion string
+
+	// IncludeSelector and ExcludeSelector, see CachingBoltConfig.IncludeSelector.
+	IncludeSelector string
+	ExcludeSelector string
+}
+
+type CachingRedis struct {
+	client *cfclient.Client
+	cc     *ccClient
+	redis  *redis.Client
+
+	config          *CachingRedisConfig
+	logger          logger
+	includeSelector *selector
+	excludeSelector *selector
+	metrics         *metrics
+}
+
+// NewCachingRedis constructs a Redis-backed Caching. Use the With* functions
+// to configure it, e.g. WithRedisAddr, WithTTL, WithIgnoreMissingApps.
+func NewCachingRedis(client *cfclient.Client, opts ...Option) (*CachingRedis, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	includeSelector, err := parseSelector(o.includeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("include selector: %s", err)
+	}
+	excludeSelector, err := parseSelector(o.excludeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("exclude selector: %s", err)
+	}
+
+	m := newMetrics(o.metricsRegisterer)
+
+	return &CachingRedis{
+		client:          client,
+		cc:              &ccClient{client: client, apiVersion: o.apiVersion, metrics: m},
+		logger:          o.logger,
+		includeSelector: includeSelector,
+		excludeSelector: excludeSelector,
+		metrics:         m,
+		config: &CachingRedisConfig{
+			Addr:               o.redisAddr,
+			Password:           o.redisPassword,
+			DB:                 o.redisDB,
+			IgnoreMissingApps:  o.ignoreMissingApps,
+			CacheInvalidateTTL: o.cacheInvalidateTTL,
+			StripAppSuffixes:   o.stripAppSuffixes,
+			APIVersion:         o.apiVersion,
+			IncludeSelector:    o.includeSelector,
+			ExcludeSelector:    o.excludeSelector,
+		},
+	}, nil
+}
+
+// NewCachingRedisWithConfig constructs a Redis-backed Caching from a
+// CachingRedisConfig.
+//
+// Deprecated: prefer NewCachingRedis with the With* options instead.
+func NewCachingRedisWithConfig(client *cfclient.Client, config *CachingRedisConfig) (*CachingRedis, error) {
+	return NewCachingRedis(client,
+		WithRedisAddr(config.Addr),
+		WithRedisPassword(config.Password),
+		WithRedisDB(config.DB),
+		WithTTL(config.CacheInvalidateTTL),
+		WithIgnoreMissingApps(config.IgnoreMissingApps),
+		WithStripAppSuffixes(config.StripAppSuffixes),
+		WithAPIVersion(config.APIVersion),
+		WithIncludeSelector(config.IncludeSelector),
+		WithExcludeSelector(config.ExcludeSelector),
+	)
+}
+
+func (c *CachingRedis) Open() error {
+	c.redis = redis.NewClient(&redis.Options{
+		Addr:     c.config.Addr,
+		Password: c.config.Password,
+		DB:       c.config.DB,
+	})
+
+	if err := c.redis.Ping().Err(); err != nil {
+		c.logger.LogError("Fail to connect to redis: ", err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *CachingRedis) Close() error {
+	return c.redis.Close()
+}
+
+// FillCache communicates with the server to enumerate *all* applications and fills
+// the cache. Only one firehose-to-syslog instance behind a given Redis does
+// this at a time: the rest find the lock held and skip straight to serving
+// out of the already-warm cache.
+func (c *CachingRedis) FillCache() error {
+	acquired, err := c.redis.SetNX(fillCacheLockKey, "1", fillCacheLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		// Another instance is already filling the cache
+		return nil
+	}
+	defer c.redis.Del(fillCacheLockKey)
+
+	stopRenew := make(chan struct{})
+	defer close(stopRenew)
+	go c.renewFillCacheLock(stopRenew)
+
+	start := time.Now()
+	defer func() { c.metrics.fillCacheDuration.Observe(time.Since(start).Seconds()) }()
+
+	allApps, err := c.cc.fetchEntityListFromAPI("apps")
+	if err != nil {
+		return err
+	}
+
+	// Populate redis with all apps
+	for guid, app := range allApps {
+		// Canonicalise the guid
+		u, err := uuid.FromString(guid)
+		if err != nil {
+			return err
+		}
+		uuid := u.String()
+
+		// Save our app out
+		err = c.normaliseAndSaveEntityToCache("apps", uuid, app)
+		if err != nil {
+			return err
+		}
+
+		// Fetch and poulate space and org
+		_, _, err = c.getSpaceAndOrg(app.SpaceGUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.metrics.fillCacheAppsTotal.Add(float64(len(allApps)))
+
+	return nil
+}
+
+// renewFillCacheLock extends fillCacheLockKey's TTL at fillCacheLockRenewInterval
+// for as long as FillCache is running, so a sweep that takes longer than a
+// single fillCacheLockTTL doesn't let another instance believe the lock has
+// expired and start a concurrent sweep. It returns once stop is closed.
+func (c *CachingRedis) renewFillCacheLock(stop <-chan struct{}) {
+	ticker := time.NewTicker(fillCacheLockRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.redis.Expire(fillCacheLockKey, fillCacheLockTTL).Err(); err != nil {
+				c.logger.LogError("Fail to renew fillcache lock: ", err)
+			}
+		}
+	}
+}
+
+// getEntity looks up the entity in the cache, and if not found, or TTL expired, fetches from the server
+// entityType *must* be checked for safety by caller
+// guid will be validated as a guid by this function
+// apps are treated specially, in that if IgnoreMissingApps is set, then an error will result in an empty object returned.
+// Also for apps, we will strip anything that matches StripAppSuffixes from the name before storing.
+func (c *CachingRedis) getEntity(entityType, guid string) (*entity, error) {
+	// Canonicalise guid
+	u, err := uuid.FromString(guid)
+	if err != nil {
+		return nil, err
+	}
+	uuid := u.String()
+
+	// Check if we have it already
+	v, err := c.redis.Get(makeRedisKey(entityType, uuid)).Result()
+	switch err {
+	case nil:
+		var rv entity
+		if err := json.Unmarshal([]byte(v), &rv); err != nil {
+			return nil, err
+		}
+		c.metrics.cacheHits.WithLabelValues(entityType).Inc()
+		return &rv, nil
+	case redis.Nil:
+		// not cached, continue below
+	default:
+		return nil, err
+	}
+
+	c.metrics.cacheMisses.WithLabelValues(entityType).Inc()
+
+	// Fetch from remote
+	nv, err := c.cc.fetchEntityFromAPI(entityType, uuid)
+	if err != nil {
+		if entityType == "apps" && c.config.IgnoreMissingApps {
+			nv = &entity{}
+		} else {
+			return nil, err
+		}
+	}
+
+	// Save it out
+	err = c.normaliseAndSaveEntityToCache(entityType, uuid, nv)
+	if err != nil {
+		return nil, err
+	}
+
+	return nv, nil
+}
+
+// makeRedisKey returns the key for the entity in redis
+// entityType is "apps" or "spaces" or "organizations" - caller must validate
+// uuid must be validated by caller
+func makeRedisKey(entityType, uuid string) string {
+	return fmt.Sprintf("%s/%s", entityType, uuid)
+}
+
+// normaliseAndSaveEntityToCache saves the entity to redis, stripping app name suffixes if enabled.
+// entityType is "apps" or "spaces" or "organizations" - caller must validate
+// uuid must be validated by caller
+// nv may be modified by this function
+func (c *CachingRedis) normaliseAndSaveEntityToCache(entityType, uuid string, nv *entity) error {
+	// Strip name suffixes if applicable. This is intended for blue green deployments,
+	// so that things like -venerable can be stripped from renamed apps
+	if entityType == "apps" {
+		for _, suffix := range c.config.StripAppSuffixes {
+			if strings.HasSuffix(nv.Name, suffix) {
+				nv.Name = nv.Name[:len(nv.Name)-len(suffix)]
+				break
+			}
+		}
+	}
+
+	b, err := json.Marshal(nv)
+	if err != nil {
+		return err
+	}
+
+	// Set TTL to value between 75% and 125% of desired amount, as a real redis TTL.
+	// This is to spread out cache invalidations.
+	ttl := time.Duration(float64(c.config.CacheInvalidateTTL.Nanoseconds()) * (0.75 + (rand.Float64() / 2.0)))
+	if err := c.redis.Set(makeRedisKey(entityType, uuid), b, ttl).Err(); err != nil {
+		return err
+	}
+
+	count, err := c.countEntities(entityType)
+	if err != nil {
+		return err
+	}
+	c.metrics.cachedEntities.WithLabelValues(entityType).Set(float64(count))
+	return nil
+}
+
+// countEntities returns the number of keys currently stored for entityType,
+// for cachedEntities' occupancy gauge. A KEYS scan rather than a running
+// counter, since Redis's own TTL-based eviction would otherwise drift a
+// counter from the keyspace's actual contents; this relies on Redis, not
+// normaliseAndSaveEntityToCache, being the source of truth for expiry.
+func (c *CachingRedis) countEntities(entityType string) (int, error) {
+	keys, err := c.redis.Keys(entityType + "/*").Result()
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+func (c *CachingRedis) getSpaceAndOrg(spaceGuid string) (*entity, *entity, error) {
+	space, err := c.getEntity("spaces", spaceGuid)
+	if err != nil {
+		if c.config.IgnoreMissingApps {
+			space = &entity{}
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	org, err := c.getEntity("organizations", space.OrganizationGUID)
+	if err != nil {
+		if c.config.IgnoreMissingApps {
+			org = &entity{}
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	return space, org, nil
+}
+
+func (c *CachingRedis) GetApp(appGuid string) (*App, error) {
+	app, err := c.getEntity("apps", appGuid)
+	if err != nil {
+		if c.config.IgnoreMissingApps {
+			app = &entity{}
+		} else {
+			return nil, err
+		}
+	}
+
+	space, org, err := c.getSpaceAndOrg(app.SpaceGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &App{
+		Guid:        appGuid,
+		Name:        app.Name,
+		SpaceGuid:   app.SpaceGUID,
+		SpaceName:   space.Name,
+		OrgGuid:     space.OrganizationGUID,
+		OrgName:     org.Name,
+		IgnoredApp:  isIgnoredApp(app, c.includeSelector, c.excludeSelector),
+		Environment: app.Environment,
+		Labels:      app.Labels,
+		Annotations: app.Annotations,
+	}, nil
+}
@@ -0,0 +1,265 @@
+package caching
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// fakeRedisServer is a tiny subset of the RESP2 protocol - just enough of
+// SET/SETNX/EXPIRE/DEL/PING for CachingRedis's FillCache lock - so the
+// locking tests below don't need a real Redis server.
+type fakeRedisServer struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake redis server: %s", err)
+	}
+	s := &fakeRedisServer{ln: ln, keys: make(map[string]string)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedisServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedisServer) Close() {
+	s.ln.Close()
+}
+
+func (s *fakeRedisServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *fakeRedisServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(s.handleCommand(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedisServer) handleCommand(args []string) []byte {
+	if len(args) == 0 {
+		return respError("empty command")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return respSimpleString("PONG")
+	case "set":
+		key, value := args[1], args[2]
+		nx := false
+		for _, opt := range args[3:] {
+			if strings.EqualFold(opt, "nx") {
+				nx = true
+			}
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if nx {
+			if _, ok := s.keys[key]; ok {
+				return respNilBulk()
+			}
+		}
+		s.keys[key] = value
+		return respSimpleString("OK")
+	case "expire":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.keys[args[1]]; ok {
+			return respInt(1)
+		}
+		return respInt(0)
+	case "del":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var n int64
+		for _, key := range args[1:] {
+			if _, ok := s.keys[key]; ok {
+				delete(s.keys, key)
+				n++
+			}
+		}
+		return respInt(n)
+	default:
+		return respError(fmt.Sprintf("unsupported command %q", args[0]))
+	}
+}
+
+// readRESPCommand reads one client request, always sent as a RESP array of
+// bulk strings (e.g. "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n").
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("expected array, got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := 0; i < n; i++ {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header = strings.TrimRight(header, "\r\n")
+		if len(header) == 0 || header[0] != '$' {
+			return nil, fmt.Errorf("expected bulk string, got %q", header)
+		}
+		l, err := strconv.Atoi(header[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, l+2) // payload + trailing CRLF
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:l])
+	}
+	return args, nil
+}
+
+func respSimpleString(s string) []byte { return []byte("+" + s + "\r\n") }
+func respInt(n int64) []byte           { return []byte(fmt.Sprintf(":%d\r\n", n)) }
+func respError(msg string) []byte      { return []byte("-ERR " + msg + "\r\n") }
+func respNilBulk() []byte              { return []byte("$-1\r\n") }
+
+// newTestCachingRedis builds a CachingRedis whose Cloud Controller requests
+// go to ts and whose Redis requests go to fake, which Open() dials in place
+// of a real Redis server.
+func newTestCachingRedis(t *testing.T, ts *httptest.Server, fake *fakeRedisServer) *CachingRedis {
+	client, err := NewCachingRedis(&cfclient.Client{
+		Config: cfclient.Config{
+			ApiAddress: ts.URL,
+			HttpClient: ts.Client(),
+		},
+	}, WithRedisAddr(fake.Addr()), WithTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := client.Open(); err != nil {
+		t.Fatalf("unexpected error opening against fake redis: %s", err)
+	}
+	return client
+}
+
+// TestFillCacheSerializesAcrossConcurrentInstances covers the SETNX lock's
+// whole point: two firehose-to-syslog instances sharing a Redis cache must
+// not both enumerate every app from the Cloud Controller API at once. It
+// simulates a second instance's FillCache call arriving while a first
+// instance's call is still in flight, and asserts the second one finds the
+// lock held and returns immediately without touching the Cloud Controller
+// API.
+func TestFillCacheSerializesAcrossConcurrentInstances(t *testing.T) {
+	fake := newFakeRedisServer(t)
+	defer fake.Close()
+
+	var requests int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/apps", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Write([]byte(`{"next_url": "", "resources": []}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	instance1 := newTestCachingRedis(t, ts, fake)
+	instance2 := newTestCachingRedis(t, ts, fake)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var err1 error
+	go func() {
+		defer wg.Done()
+		err1 = instance1.FillCache()
+	}()
+
+	<-started // instance1 has acquired the lock and is mid-FillCache
+
+	if err := instance2.FillCache(); err != nil {
+		t.Fatalf("instance2: unexpected error: %s", err)
+	}
+
+	close(release)
+	wg.Wait()
+	if err1 != nil {
+		t.Fatalf("instance1: unexpected error: %s", err1)
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("expected instance2 to skip the Cloud Controller API entirely while the lock was held, got %d total requests", got)
+	}
+}
+
+// TestFillCacheReleasesLockForNextRun covers the other half of the lock's
+// contract: once a FillCache run finishes, it must release the lock so a
+// later run - whether from the same instance or another one - isn't
+// permanently blocked out.
+func TestFillCacheReleasesLockForNextRun(t *testing.T) {
+	fake := newFakeRedisServer(t)
+	defer fake.Close()
+
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/apps", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"next_url": "", "resources": []}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	instance := newTestCachingRedis(t, ts, fake)
+
+	if err := instance.FillCache(); err != nil {
+		t.Fatalf("first run: unexpected error: %s", err)
+	}
+	if err := instance.FillCache(); err != nil {
+		t.Fatalf("second run: unexpected error: %s", err)
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("expected both runs to reach the Cloud Controller API, got %d requests", got)
+	}
+}
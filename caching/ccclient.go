@@ -0,0 +1,281 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"golang.org/x/sync/singleflight"
+)
+
+// Cloud Controller API versions supported by the APIVersion config/option.
+const (
+	apiVersionV2 = "v2"
+	apiVersionV3 = "v3"
+)
+
+// entity is the cached representation of a CF app, space or organization.
+// Not every field is populated for every entityType - e.g. an organization
+// has no SpaceGUID.
+type entity struct {
+	Name             string                 `json:"name"`
+	SpaceGUID        string                 `json:"space_guid"`
+	OrganizationGUID string                 `json:"organization_guid"`
+	Environment      map[string]interface{} `json:"environment_json"`
+	Labels           map[string]string
+	Annotations      map[string]string
+	TTL              time.Time
+}
+
+func (e *entity) appIsOptOut() bool {
+	return e.Environment["F2S_DISABLE_LOGGING"] == "true"
+}
+
+// selectableAttributes merges the entity's environment variables
+// (stringified) with its v3 labels and annotations, so an --include-selector
+// or --exclude-selector can be written against whichever the Cloud
+// Controller API version in use actually provides. Labels and annotations
+// take precedence over environment variables of the same name.
+func (e *entity) selectableAttributes() map[string]string {
+	attrs := make(map[string]string, len(e.Environment)+len(e.Labels)+len(e.Annotations))
+	for k, v := range e.Environment {
+		attrs[k] = fmt.Sprintf("%v", v)
+	}
+	for k, v := range e.Labels {
+		attrs[k] = v
+	}
+	for k, v := range e.Annotations {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// ccClient fetches apps/spaces/organizations from the Cloud Controller API
+// on behalf of a Caching backend, transparently handling the v2/v3 envelope
+// and pagination differences. It holds no cache state of its own - that's
+// the caller's job.
+type ccClient struct {
+	client     *cfclient.Client
+	apiVersion string
+	metrics    *metrics
+
+	// sf coalesces concurrent fetchEntityFromAPI calls for the same
+	// entityType/guid into a single upstream request, so a burst of
+	// firehose events for the same handful of apps against a cold cache
+	// doesn't stampede the Cloud Controller API.
+	sf singleflight.Group
+}
+
+// fetchEntityListFromAPI fetches a full list of all such entities from the server
+// entityType must have been validated by the caller
+func (c *ccClient) fetchEntityListFromAPI(entityType string) (map[string]*entity, error) {
+	if c.apiVersion == apiVersionV3 {
+		return c.fetchEntityListFromAPIV3(entityType)
+	}
+
+	url := fmt.Sprintf("/v2/%s?results-per-page=100", entityType)
+	rv := make(map[string]*entity)
+	for {
+		var md struct {
+			NextURL   string `json:"next_url"`
+			Resources []*struct {
+				Metadata struct {
+					GUID string `json:"guid"`
+				} `json:"metadata"`
+				Entity *entity `json:"entity"`
+			} `json:"resources"`
+		}
+		err := c.makeRequestAndDecodeJSON(entityType, url, &md)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range md.Resources {
+			rv[r.Metadata.GUID] = r.Entity
+		}
+
+		if md.NextURL == "" {
+			// we're done!
+			return rv, nil
+		}
+
+		url = md.NextURL
+	}
+}
+
+// fetchEntityFromAPI fetches a single entity from the server, coalescing
+// concurrent callers asking for the same entityType/guid into one request.
+// Each caller gets back its own copy of the entity, since callers (e.g.
+// getEntity's TTL stamping, normaliseAndSaveEntityToDatabase's suffix
+// stripping) mutate the result in place and singleflight.Do would otherwise
+// hand every coalesced caller the same shared pointer.
+// both entityType and guid must have been validated by the caller
+func (c *ccClient) fetchEntityFromAPI(entityType, guid string) (*entity, error) {
+	v, err, _ := c.sf.Do(entityType+"/"+guid, func() (interface{}, error) {
+		return c.fetchEntityFromAPIUncoalesced(entityType, guid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	clone := *v.(*entity)
+	return &clone, nil
+}
+
+// both entityType and guid must have been validated by the caller
+func (c *ccClient) fetchEntityFromAPIUncoalesced(entityType, guid string) (*entity, error) {
+	if c.apiVersion == apiVersionV3 {
+		return c.fetchEntityFromAPIV3(entityType, guid)
+	}
+
+	var md struct {
+		Entity *entity `json:"entity"`
+	}
+	err := c.makeRequestAndDecodeJSON(entityType, fmt.Sprintf("/v2/%s/%s", entityType, guid), &md)
+	if err != nil {
+		return nil, err
+	}
+	return md.Entity, nil
+}
+
+// v3Resource is the flat resource layout used by the Cloud Controller v3
+// API, shared by apps, spaces and organizations. Fields that don't apply to
+// a given entityType (e.g. a space has no relationships.space) simply
+// decode to their zero value.
+type v3Resource struct {
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	Relationships struct {
+		Space struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+		Organization struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"organization"`
+	} `json:"relationships"`
+	Metadata struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+func (r *v3Resource) toEntity() *entity {
+	return &entity{
+		Name:             r.Name,
+		SpaceGUID:        r.Relationships.Space.Data.GUID,
+		OrganizationGUID: r.Relationships.Organization.Data.GUID,
+		Labels:           r.Metadata.Labels,
+		Annotations:      r.Metadata.Annotations,
+	}
+}
+
+// v3EnvironmentVariables is the body of GET
+// /v3/apps/:guid/environment_variables.
+type v3EnvironmentVariables struct {
+	Var map[string]interface{} `json:"var"`
+}
+
+// fetchV3AppEnvironment fetches an app's user-provided environment
+// variables. Unlike v2, a v3 app resource doesn't embed environment_json -
+// it lives behind its own endpoint, so it has to be fetched separately and
+// merged in. This is what entity.appIsOptOut's F2S_DISABLE_LOGGING check
+// relies on, so it must be fetched whenever resolving an app via v3.
+func (c *ccClient) fetchV3AppEnvironment(guid string) (map[string]interface{}, error) {
+	var ev v3EnvironmentVariables
+	err := c.makeRequestAndDecodeJSON("apps", fmt.Sprintf("/v3/apps/%s/environment_variables", guid), &ev)
+	if err != nil {
+		return nil, err
+	}
+	return ev.Var, nil
+}
+
+// fetchEntityListFromAPIV3 is the v3 equivalent of fetchEntityListFromAPI,
+// following pagination.next.href rather than the v2 next_url field.
+// entityType must have been validated by the caller
+func (c *ccClient) fetchEntityListFromAPIV3(entityType string) (map[string]*entity, error) {
+	url := fmt.Sprintf("/v3/%s?per_page=100", entityType)
+	rv := make(map[string]*entity)
+	for {
+		var md struct {
+			Pagination struct {
+				Next struct {
+					Href string `json:"href"`
+				} `json:"next"`
+			} `json:"pagination"`
+			Resources []*v3Resource `json:"resources"`
+		}
+		err := c.makeRequestAndDecodeJSON(entityType, url, &md)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range md.Resources {
+			e := r.toEntity()
+			if entityType == "apps" {
+				env, err := c.fetchV3AppEnvironment(r.GUID)
+				if err != nil {
+					return nil, err
+				}
+				e.Environment = env
+			}
+			rv[r.GUID] = e
+		}
+
+		if md.Pagination.Next.Href == "" {
+			// we're done!
+			return rv, nil
+		}
+
+		url = md.Pagination.Next.Href
+	}
+}
+
+// both entityType and guid must have been validated by the caller
+func (c *ccClient) fetchEntityFromAPIV3(entityType, guid string) (*entity, error) {
+	var r v3Resource
+	err := c.makeRequestAndDecodeJSON(entityType, fmt.Sprintf("/v3/%s/%s", entityType, guid), &r)
+	if err != nil {
+		return nil, err
+	}
+	e := r.toEntity()
+	if entityType == "apps" {
+		env, err := c.fetchV3AppEnvironment(guid)
+		if err != nil {
+			return nil, err
+		}
+		e.Environment = env
+	}
+	return e, nil
+}
+
+// makeRequestAndDecodeJSON issues a GET against the Cloud Controller API and
+// decodes the JSON response body into rv, recording the request's latency
+// and, on failure, its status code against entityType in c.metrics.
+func (c *ccClient) makeRequestAndDecodeJSON(entityType, url string, rv interface{}) error {
+	start := time.Now()
+	resp, err := c.client.DoRequestWithoutRedirects(c.client.NewRequest(http.MethodGet, url))
+	if err != nil {
+		c.metrics.ccRequestErrors.WithLabelValues(entityType, "error").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	c.metrics.ccRequestLatency.WithLabelValues(entityType).Observe(time.Since(start).Seconds())
+
+	if resp.StatusCode != http.StatusOK {
+		c.metrics.ccRequestErrors.WithLabelValues(entityType, strconv.Itoa(resp.StatusCode)).Inc()
+		return fmt.Errorf("bad status code: %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(rv)
+	if err != nil {
+		return err
+	}
+
+	return err
+}
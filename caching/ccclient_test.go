@@ -0,0 +1,212 @@
+package caching
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// newTestCCClient builds a ccClient whose requests go to ts, bypassing
+// cfclient.NewClient's OAuth/endpoint bootstrapping (not needed here since
+// ccClient only calls client.NewRequest/DoRequestWithoutRedirects).
+func newTestCCClient(ts *httptest.Server, apiVersion string) *ccClient {
+	return &ccClient{
+		client: &cfclient.Client{
+			Config: cfclient.Config{
+				ApiAddress: ts.URL,
+				HttpClient: ts.Client(),
+			},
+		},
+		apiVersion: apiVersion,
+		metrics:    newMetrics(nil),
+	}
+}
+
+func TestFetchEntityListFromAPIV2Pagination(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/apps", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"next_url": "/v2/apps/page2",
+			"resources": [{"metadata": {"guid": "guid-1"}, "entity": {"name": "app-1"}}]
+		}`))
+	})
+	mux.HandleFunc("/v2/apps/page2", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"next_url": "",
+			"resources": [{"metadata": {"guid": "guid-2"}, "entity": {"name": "app-2"}}]
+		}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cc := newTestCCClient(ts, apiVersionV2)
+	apps, err := cc.fetchEntityListFromAPI("apps")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(apps) != 2 {
+		t.Fatalf("expected 2 apps across both pages, got %d", len(apps))
+	}
+	if apps["guid-1"].Name != "app-1" || apps["guid-2"].Name != "app-2" {
+		t.Fatalf("unexpected apps: %+v", apps)
+	}
+}
+
+func TestFetchEntityListFromAPIV3Pagination(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/apps", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"pagination": map[string]interface{}{"next": map[string]interface{}{"href": "/v3/apps/page2"}},
+			"resources":  []map[string]interface{}{{"guid": "guid-1", "name": "app-1"}},
+		})
+	})
+	mux.HandleFunc("/v3/apps/page2", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"pagination": map[string]interface{}{"next": map[string]interface{}{"href": ""}},
+			"resources":  []map[string]interface{}{{"guid": "guid-2", "name": "app-2"}},
+		})
+	})
+	mux.HandleFunc("/v3/apps/guid-1/environment_variables", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"var": map[string]interface{}{"F2S_DISABLE_LOGGING": "true"}})
+	})
+	mux.HandleFunc("/v3/apps/guid-2/environment_variables", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"var": map[string]interface{}{}})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cc := newTestCCClient(ts, apiVersionV3)
+	apps, err := cc.fetchEntityListFromAPI("apps")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(apps) != 2 {
+		t.Fatalf("expected 2 apps across both pages, got %d", len(apps))
+	}
+	if apps["guid-1"].Environment["F2S_DISABLE_LOGGING"] != "true" {
+		t.Fatalf("expected guid-1's environment_variables to be merged in, got %+v", apps["guid-1"])
+	}
+	if len(apps["guid-2"].Environment) != 0 {
+		t.Fatalf("expected guid-2 to have no environment variables, got %+v", apps["guid-2"].Environment)
+	}
+}
+
+func TestFetchEntityFromAPIDispatchesOnVersion(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/spaces/guid-1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"entity": {"name": "space-v2"}}`))
+	})
+	mux.HandleFunc("/v3/spaces/guid-1", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"guid": "guid-1", "name": "space-v3"})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v2 := newTestCCClient(ts, apiVersionV2)
+	e, err := v2.fetchEntityFromAPI("spaces", "guid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if e.Name != "space-v2" {
+		t.Fatalf("expected v2 client to hit /v2/spaces, got name %q", e.Name)
+	}
+
+	v3 := newTestCCClient(ts, apiVersionV3)
+	e, err = v3.fetchEntityFromAPI("spaces", "guid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if e.Name != "space-v3" {
+		t.Fatalf("expected v3 client to hit /v3/spaces, got name %q", e.Name)
+	}
+	// Spaces don't have environment variables - fetchEntityFromAPIV3 must
+	// not have tried to hit the (nonexistent) environment_variables route.
+	if len(e.Environment) != 0 {
+		t.Fatalf("expected no environment for a space, got %+v", e.Environment)
+	}
+}
+
+// TestFetchEntityFromAPIReturnsIndependentCopies guards against
+// fetchEntityFromAPI handing every caller the same *entity returned by
+// singleflight: getEntity and normaliseAndSaveEntityTo* mutate the result
+// (TTL, Name) after the call returns, so distinct callers - coalesced or
+// not - must never share a pointer.
+func TestFetchEntityFromAPIReturnsIndependentCopies(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/spaces/guid-1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"entity": {"name": "space-1"}}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cc := newTestCCClient(ts, apiVersionV2)
+	a, err := cc.fetchEntityFromAPI("spaces", "guid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := cc.fetchEntityFromAPI("spaces", "guid-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if a == b {
+		t.Fatalf("expected independent entity pointers per call, got the same pointer")
+	}
+	a.Name = "mutated"
+	if b.Name == "mutated" {
+		t.Fatalf("mutating one caller's entity must not affect another's")
+	}
+}
+
+// TestFetchEntityFromAPICoalescesConcurrentCallers is the genuinely
+// concurrent counterpart to TestFetchEntityFromAPIReturnsIndependentCopies:
+// it asserts singleflight actually collapses many simultaneous lookups of
+// the same entityType/guid into a single upstream request, which is the
+// whole point of ccClient.sf.
+func TestFetchEntityFromAPICoalescesConcurrentCallers(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/spaces/guid-1", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write([]byte(`{"entity": {"name": "space-1"}}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cc := newTestCCClient(ts, apiVersionV2)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			_, err := cc.fetchEntityFromAPI("spaces", "guid-1")
+			errs[i] = err
+		}(i)
+	}
+
+	// Give every goroutine a chance to join the in-flight singleflight call
+	// before letting the handler return, so they're all coalesced into it
+	// rather than some completing and others starting a fresh call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: unexpected error: %s", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("expected exactly 1 upstream request for %d coalesced callers, got %d", callers, got)
+	}
+}
@@ -0,0 +1,101 @@
+package caching
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus collectors shared by every Caching backend.
+// If no Registerer was supplied via WithMetricsRegisterer the collectors
+// are still created and safe to use, they're just never exposed on a
+// /metrics endpoint.
+type metrics struct {
+	cacheHits          *prometheus.CounterVec
+	cacheMisses        *prometheus.CounterVec
+	cachedEntities     *prometheus.GaugeVec
+	ccRequestLatency   *prometheus.HistogramVec
+	ccRequestErrors    *prometheus.CounterVec
+	fillCacheDuration  prometheus.Histogram
+	fillCacheAppsTotal prometheus.Counter
+}
+
+// metricsByRegistry deduplicates metrics construction per Registerer, so
+// that constructing more than one Caching backend against the same shared
+// *prometheus.Registry (e.g. a second instance in tests) doesn't panic on
+// duplicate registration. A nil Registerer - the common case of unexposed,
+// per-instance metrics - is never deduplicated.
+var (
+	metricsMu         sync.Mutex
+	metricsByRegistry = map[prometheus.Registerer]*metrics{}
+)
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	if reg != nil {
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		if m, ok := metricsByRegistry[reg]; ok {
+			return m
+		}
+	}
+
+	m := &metrics{
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "firehose_to_syslog",
+			Subsystem: "caching",
+			Name:      "cache_hits_total",
+			Help:      "Number of cache hits, by entity type.",
+		}, []string{"entity_type"}),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "firehose_to_syslog",
+			Subsystem: "caching",
+			Name:      "cache_misses_total",
+			Help:      "Number of cache misses, by entity type.",
+		}, []string{"entity_type"}),
+		cachedEntities: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "firehose_to_syslog",
+			Subsystem: "caching",
+			Name:      "cached_entities",
+			Help:      "Current number of cached entities, by entity type. Includes entries that are TTL-expired but not yet refreshed or evicted.",
+		}, []string{"entity_type"}),
+		ccRequestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "firehose_to_syslog",
+			Subsystem: "caching",
+			Name:      "cc_request_duration_seconds",
+			Help:      "Latency of upstream Cloud Controller API requests, by entity type.",
+		}, []string{"entity_type"}),
+		ccRequestErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "firehose_to_syslog",
+			Subsystem: "caching",
+			Name:      "cc_request_errors_total",
+			Help:      "Number of failed upstream Cloud Controller API requests, by entity type and status code.",
+		}, []string{"entity_type", "status_code"}),
+		fillCacheDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "firehose_to_syslog",
+			Subsystem: "caching",
+			Name:      "fill_cache_duration_seconds",
+			Help:      "Duration of FillCache runs.",
+		}),
+		fillCacheAppsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "firehose_to_syslog",
+			Subsystem: "caching",
+			Name:      "fill_cache_apps_total",
+			Help:      "Total number of apps loaded across all FillCache runs.",
+		}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(
+			m.cacheHits,
+			m.cacheMisses,
+			m.cachedEntities,
+			m.ccRequestLatency,
+			m.ccRequestErrors,
+			m.fillCacheDuration,
+			m.fillCacheAppsTotal,
+		)
+		metricsByRegistry[reg] = m
+	}
+
+	return m
+}
@@ -0,0 +1,130 @@
+package caching
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logger is the subset of github.com/cloudfoundry-community/firehose-to-syslog/logging
+// that the caching backends need, so callers can inject a test double via WithLogger.
+type logger interface {
+	LogError(msg string, err interface{})
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) LogError(msg string, err interface{}) {
+	logging.LogError(msg, err)
+}
+
+// options holds the settings shared by every Caching backend constructor.
+// Each backend copies the fields it understands out of options into its own
+// config struct, so adding a new knob only means adding one more With*
+// function here rather than widening every backend's config struct.
+type options struct {
+	path               string
+	cacheInvalidateTTL time.Duration
+	ignoreMissingApps  bool
+	stripAppSuffixes   []string
+	apiVersion         string
+	logger             logger
+	redisAddr          string
+	redisPassword      string
+	redisDB            int
+	includeSelector    string
+	excludeSelector    string
+	metricsRegisterer  prometheus.Registerer
+}
+
+func defaultOptions() *options {
+	return &options{
+		apiVersion: apiVersionV2,
+		logger:     defaultLogger{},
+	}
+}
+
+// Option configures a Caching backend constructor.
+type Option func(*options)
+
+// WithPath sets the path to the backend's backing store file, where
+// applicable (e.g. CachingBolt's boltdb file).
+func WithPath(path string) Option {
+	return func(o *options) { o.path = path }
+}
+
+// WithTTL sets the approximate cache invalidation TTL. CachingBolt and
+// CachingRedis expire entries at a random point between 0.75x and 1.25x
+// this duration, to spread out cache invalidations; CachingMemory uses the
+// duration as-is, without jitter.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) { o.cacheInvalidateTTL = ttl }
+}
+
+// WithIgnoreMissingApps makes lookups for apps/spaces/orgs that error
+// against the Cloud Controller API return an empty entity instead of an
+// error.
+func WithIgnoreMissingApps(ignore bool) Option {
+	return func(o *options) { o.ignoreMissingApps = ignore }
+}
+
+// WithStripAppSuffixes strips the first matching suffix from cached app
+// names. Intended for blue/green deployments, so that things like
+// "-venerable" can be stripped from renamed apps.
+func WithStripAppSuffixes(suffixes []string) Option {
+	return func(o *options) { o.stripAppSuffixes = suffixes }
+}
+
+// WithAPIVersion selects which Cloud Controller API is used to resolve
+// apps, spaces and organizations: "v2" (default) or "v3".
+func WithAPIVersion(version string) Option {
+	return func(o *options) { o.apiVersion = version }
+}
+
+// WithLogger overrides the logger used to report backend errors. Defaults
+// to the package-level logging.LogError.
+func WithLogger(l logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// WithRedisAddr sets the "host:port" address of the Redis server used by
+// CachingRedis.
+func WithRedisAddr(addr string) Option {
+	return func(o *options) { o.redisAddr = addr }
+}
+
+// WithRedisPassword sets the password used to authenticate to Redis, where
+// applicable.
+func WithRedisPassword(password string) Option {
+	return func(o *options) { o.redisPassword = password }
+}
+
+// WithRedisDB selects the numbered Redis database used by CachingRedis.
+func WithRedisDB(db int) Option {
+	return func(o *options) { o.redisDB = db }
+}
+
+// WithIncludeSelector restricts GetApp to apps matching a Kubernetes-style
+// selector (e.g. "team=platform,tier!=batch") evaluated against the app's
+// environment variables, and its labels/annotations when using the v3 API.
+// Apps that don't match are returned with IgnoredApp set. An empty selector
+// matches everything.
+func WithIncludeSelector(expr string) Option {
+	return func(o *options) { o.includeSelector = expr }
+}
+
+// WithExcludeSelector is the opposite of WithIncludeSelector: apps matching
+// the selector are returned with IgnoredApp set. An empty selector excludes
+// nothing.
+func WithExcludeSelector(expr string) Option {
+	return func(o *options) { o.excludeSelector = expr }
+}
+
+// WithMetricsRegisterer registers the backend's Prometheus metrics (cache
+// hits/misses, upstream Cloud Controller latency/errors, FillCache duration,
+// cached-entity counts) against reg. If not set, the metrics are created but
+// left unregistered.
+func WithMetricsRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) { o.metricsRegisterer = reg }
+}
@@ -0,0 +1,98 @@
+package caching
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selector is a parsed Kubernetes-style label selector, e.g.
+// "team=platform,tier!=batch". A selector with no requirements matches
+// everything, which is what an unset --include-selector/--exclude-selector
+// parses to.
+type selector struct {
+	requirements []selectorRequirement
+}
+
+type selectorRequirement struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// parseSelector parses a comma-separated "key=value,key!=value" expression
+// into a selector. An empty expression is valid and matches everything.
+func parseSelector(expr string) (*selector, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return &selector{}, nil
+	}
+
+	var reqs []selectorRequirement
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		sep := "="
+		negate := false
+		if strings.Contains(term, "!=") {
+			sep = "!="
+			negate = true
+		}
+
+		parts := strings.SplitN(term, sep, 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid selector term %q, expected key%svalue", term, sep)
+		}
+
+		reqs = append(reqs, selectorRequirement{
+			key:    strings.TrimSpace(parts[0]),
+			value:  strings.TrimSpace(parts[1]),
+			negate: negate,
+		})
+	}
+
+	return &selector{requirements: reqs}, nil
+}
+
+// matches reports whether every requirement in the selector is satisfied by attrs.
+func (s *selector) matches(attrs map[string]string) bool {
+	for _, r := range s.requirements {
+		v, ok := attrs[r.key]
+		if r.negate {
+			if ok && v == r.value {
+				return false
+			}
+			continue
+		}
+		if !ok || v != r.value {
+			return false
+		}
+	}
+	return true
+}
+
+// isIgnoredApp reports whether an app should be marked IgnoredApp, either by
+// the legacy F2S_DISABLE_LOGGING env var opt-out, or by either configured
+// selector. include/exclude may be nil, meaning "not configured".
+func isIgnoredApp(app *entity, include, exclude *selector) bool {
+	if app.appIsOptOut() {
+		return true
+	}
+
+	attrs := app.selectableAttributes()
+	// An unconfigured ExcludeSelector parses to a *selector with zero
+	// requirements, and matches() vacuously returns true when there's
+	// nothing to fail - so exclude must only take effect once it actually
+	// has requirements, or every app would match it and get ignored by
+	// default.
+	if exclude != nil && len(exclude.requirements) > 0 && exclude.matches(attrs) {
+		return true
+	}
+	if include != nil && !include.matches(attrs) {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,122 @@
+package caching
+
+import "testing"
+
+func TestParseSelectorEmpty(t *testing.T) {
+	s, err := parseSelector("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(s.requirements) != 0 {
+		t.Fatalf("expected no requirements, got %v", s.requirements)
+	}
+	if !s.matches(map[string]string{"anything": "goes"}) {
+		t.Fatalf("empty selector should match everything")
+	}
+}
+
+func TestParseSelectorEqualityAndNegation(t *testing.T) {
+	s, err := parseSelector("team=platform, tier!=batch")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(s.requirements) != 2 {
+		t.Fatalf("expected 2 requirements, got %d", len(s.requirements))
+	}
+
+	if !s.matches(map[string]string{"team": "platform", "tier": "web"}) {
+		t.Fatalf("expected match: team=platform, tier!=batch (tier=web)")
+	}
+	if s.matches(map[string]string{"team": "platform", "tier": "batch"}) {
+		t.Fatalf("expected no match: tier=batch should fail tier!=batch")
+	}
+	if s.matches(map[string]string{"team": "other", "tier": "web"}) {
+		t.Fatalf("expected no match: team=platform not satisfied")
+	}
+	// A missing key satisfies a != requirement.
+	if !s.matches(map[string]string{"team": "platform"}) {
+		t.Fatalf("expected match: a missing key should satisfy !=")
+	}
+}
+
+func TestParseSelectorInvalidTerm(t *testing.T) {
+	if _, err := parseSelector("noequalssign"); err == nil {
+		t.Fatalf("expected an error for a term with no separator")
+	}
+}
+
+func TestParseSelectorIgnoresBlankTerms(t *testing.T) {
+	s, err := parseSelector("team=platform,,tier=web")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(s.requirements) != 2 {
+		t.Fatalf("expected blank terms between commas to be skipped, got %d requirements", len(s.requirements))
+	}
+}
+
+func TestIsIgnoredApp(t *testing.T) {
+	include, err := parseSelector("team=platform")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exclude, err := parseSelector("tier=batch")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	matching := &entity{Environment: map[string]interface{}{"team": "platform"}}
+	if isIgnoredApp(matching, include, exclude) {
+		t.Fatalf("app matching include and not matching exclude should not be ignored")
+	}
+
+	wrongTeam := &entity{Environment: map[string]interface{}{"team": "other"}}
+	if !isIgnoredApp(wrongTeam, include, exclude) {
+		t.Fatalf("app failing include selector should be ignored")
+	}
+
+	excluded := &entity{Environment: map[string]interface{}{"team": "platform", "tier": "batch"}}
+	if !isIgnoredApp(excluded, include, exclude) {
+		t.Fatalf("app matching exclude selector should be ignored")
+	}
+
+	optedOut := &entity{Environment: map[string]interface{}{"team": "platform", "F2S_DISABLE_LOGGING": "true"}}
+	if !isIgnoredApp(optedOut, include, exclude) {
+		t.Fatalf("F2S_DISABLE_LOGGING=true should always be ignored, regardless of selectors")
+	}
+}
+
+// TestIsIgnoredAppDefaultSelectorsMatchEverything covers the common case of
+// an unconfigured --include-selector/--exclude-selector: parseSelector("")
+// returns a *selector with zero requirements, and matches() vacuously
+// returns true for it. isIgnoredApp must not treat that vacuous true as "the
+// exclude selector matched" - otherwise every app would be ignored by
+// default.
+func TestIsIgnoredAppDefaultSelectorsMatchEverything(t *testing.T) {
+	include, err := parseSelector("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exclude, err := parseSelector("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	app := &entity{Environment: map[string]interface{}{"team": "platform"}}
+	if isIgnoredApp(app, include, exclude) {
+		t.Fatalf("an app should not be ignored by default, unconfigured selectors")
+	}
+}
+
+func TestSelectableAttributesPrecedence(t *testing.T) {
+	e := &entity{
+		Environment: map[string]interface{}{"team": "env-value"},
+		Labels:      map[string]string{"team": "label-value"},
+		Annotations: map[string]string{"team": "annotation-value"},
+	}
+
+	attrs := e.selectableAttributes()
+	if attrs["team"] != "annotation-value" {
+		t.Fatalf("expected annotations to take precedence, got %q", attrs["team"])
+	}
+}